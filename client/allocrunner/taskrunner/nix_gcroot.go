@@ -0,0 +1,226 @@
+package taskrunner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+const (
+	// nixGCRootsDir is relative to the client's data dir and holds one
+	// symlink per distinct (flake, flakeArgs) build, shared across every
+	// alloc/task that references it.
+	nixGCRootsDir = "nix/gcroots"
+
+	// defaultNixGCMinFreeBytes is the free-disk floor under which the
+	// reaper runs `nix-collect-garbage` if no client.nix override is set.
+	defaultNixGCMinFreeBytes = 5 * 1024 * 1024 * 1024 // 5 GiB
+
+	// defaultNixGCCheckInterval is how often the reaper polls free disk.
+	defaultNixGCCheckInterval = 5 * time.Minute
+)
+
+var (
+	nixGCRootManagersMu sync.Mutex
+	nixGCRootManagers   = map[string]*nixGCRootManager{}
+)
+
+// getNixGCRootManager returns the node-level GC root manager for dataDir,
+// creating (and starting the reaper for) it on first use. Every nixHook on
+// this node shares the same manager so that concurrent allocs building the
+// same flake see each other's in-progress and completed roots.
+func getNixGCRootManager(dataDir string, nixConfig *NixConfig, logger hclog.Logger) *nixGCRootManager {
+	nixGCRootManagersMu.Lock()
+	defer nixGCRootManagersMu.Unlock()
+
+	if m, ok := nixGCRootManagers[dataDir]; ok {
+		return m
+	}
+
+	m := newNixGCRootManager(dataDir, nixConfig, logger)
+	nixGCRootManagers[dataDir] = m
+	m.startReaper()
+	return m
+}
+
+// nixGCRoot tracks the allocations currently referencing a shared build
+// output, so we only unlink it once the last referencing alloc is gone.
+type nixGCRoot struct {
+	outPath string
+	// requisites caches the output of `nix-store --query --requisites
+	// outPath` from the build that created this root, so a cache hit never
+	// has to re-run that subprocess.
+	requisites []string
+	allocs     map[string]struct{}
+}
+
+// nixGCRootManager maintains Nix GC roots under a shared client data dir
+// instead of inside each task dir, so that concurrent allocs building the
+// same flake share one build and one GC root, and removing an alloc doesn't
+// silently orphan the underlying store paths.
+type nixGCRootManager struct {
+	mu        sync.Mutex
+	dir       string
+	nixConfig *NixConfig
+	logger    hclog.Logger
+	roots     map[string]*nixGCRoot // keyed by build hash
+	reapOnce  sync.Once
+}
+
+func newNixGCRootManager(dataDir string, nixConfig *NixConfig, logger hclog.Logger) *nixGCRootManager {
+	return &nixGCRootManager{
+		dir:       filepath.Join(dataDir, nixGCRootsDir),
+		nixConfig: nixConfig,
+		logger:    logger.Named("nix_gc"),
+		roots:     make(map[string]*nixGCRoot),
+	}
+}
+
+// link returns the path of the GC root symlink for hash, creating the
+// gcroots directory if necessary.
+func (m *nixGCRootManager) link(hash string) (string, error) {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create nix gcroots dir %q: %v", m.dir, err)
+	}
+	return filepath.Join(m.dir, hash), nil
+}
+
+// resolve returns the store path a GC root currently points at and its
+// cached requisites, if the symlink exists, its target is still present in
+// the store, and we still hold the requisites list from the build that
+// created it (we don't just after a client restart, when the symlink is
+// still on disk but m.roots starts out empty). The caller must re-query requisites itself when ok is true but the
+// returned requisites are empty.
+func (m *nixGCRootManager) resolve(hash string) (outPath string, requisites []string, ok bool) {
+	link, err := m.link(hash)
+	if err != nil {
+		return "", nil, false
+	}
+
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", nil, false
+	}
+
+	if _, err := os.Stat(target); err != nil {
+		return "", nil, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if root, ok := m.roots[hash]; ok {
+		requisites = root.requisites
+	}
+
+	return target, requisites, true
+}
+
+// acquire records that allocID is now using the build identified by hash,
+// whose resolved output is outPath and whose requisites are requisites.
+// Safe to call repeatedly for the same alloc (e.g. task restarts).
+func (m *nixGCRootManager) acquire(hash, outPath string, requisites []string, allocID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	root, ok := m.roots[hash]
+	if !ok {
+		root = &nixGCRoot{outPath: outPath, requisites: requisites, allocs: make(map[string]struct{})}
+		m.roots[hash] = root
+	} else if root.requisites == nil {
+		root.requisites = requisites
+	}
+	root.allocs[allocID] = struct{}{}
+}
+
+// release drops allocID's reference to hash. Once no alloc references a
+// root any more it's removed; the underlying store paths stay in the Nix
+// store until the reaper runs `nix-collect-garbage`.
+func (m *nixGCRootManager) release(hash, allocID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	root, ok := m.roots[hash]
+	if !ok {
+		return
+	}
+
+	delete(root.allocs, allocID)
+	if len(root.allocs) > 0 {
+		return
+	}
+
+	delete(m.roots, hash)
+	link, err := m.link(hash)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		m.logger.Warn("failed to remove nix gc root", "hash", hash, "error", err)
+	}
+}
+
+// startReaper launches the periodic goroutine that runs
+// `nix-collect-garbage` whenever free disk under the data dir falls below
+// the configured threshold. It's idempotent so repeated calls on the same
+// manager (e.g. from multiple hooks racing to create it) only start one.
+func (m *nixGCRootManager) startReaper() {
+	m.reapOnce.Do(func() {
+		go m.reapLoop()
+	})
+}
+
+func (m *nixGCRootManager) reapLoop() {
+	interval := m.nixConfig.GCCheckInterval
+	if interval <= 0 {
+		interval = defaultNixGCCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.reapIfLow()
+	}
+}
+
+func (m *nixGCRootManager) reapIfLow() {
+	threshold := m.nixConfig.GCMinFreeBytes
+	if threshold <= 0 {
+		threshold = defaultNixGCMinFreeBytes
+	}
+
+	free, err := freeDiskBytes(m.dir)
+	if err != nil {
+		m.logger.Debug("failed to stat free disk, skipping gc check", "error", err)
+		return
+	}
+
+	if free >= uint64(threshold) {
+		return
+	}
+
+	m.logger.Info("free disk below threshold, running nix-collect-garbage",
+		"free_bytes", free, "threshold_bytes", threshold)
+
+	cmd := exec.Command("nix-collect-garbage", "-d")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		m.logger.Error("nix-collect-garbage failed", "error", err, "output", string(output))
+		return
+	}
+	m.logger.Debug("nix-collect-garbage finished", "output", string(output))
+}
+
+func freeDiskBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
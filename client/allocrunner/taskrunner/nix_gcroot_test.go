@@ -0,0 +1,55 @@
+package taskrunner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNixGCRootManager_SharedBuild simulates two tasks referencing the same
+// flake build: only the first should see a cache miss (and thus be the one
+// to "build"), the second should resolve the existing GC root, and the
+// build output should only be torn down once both allocs have released it.
+func TestNixGCRootManager_SharedBuild(t *testing.T) {
+	dataDir := t.TempDir()
+	storePath := filepath.Join(t.TempDir(), "store-path")
+	require.NoError(t, os.WriteFile(storePath, []byte("fake output"), 0644))
+
+	m := newNixGCRootManager(dataDir, DefaultNixConfig(), hclog.NewNullLogger())
+
+	const hash = "deadbeef"
+	requisites := []string{storePath}
+
+	// task A: cache miss, "builds" by creating the GC root symlink itself.
+	_, _, ok := m.resolve(hash)
+	require.False(t, ok, "expected cache miss before any build")
+
+	link, err := m.link(hash)
+	require.NoError(t, err)
+	require.NoError(t, os.Symlink(storePath, link))
+	m.acquire(hash, storePath, requisites, "alloc-a")
+
+	// task B: cache hit, no second build required, and the requisites list
+	// computed by task A's build comes back too so task B never has to
+	// re-run `nix-store --query --requisites`.
+	resolved, cachedRequisites, ok := m.resolve(hash)
+	require.True(t, ok, "expected cache hit for second task")
+	require.Equal(t, storePath, resolved)
+	require.Equal(t, requisites, cachedRequisites)
+	m.acquire(hash, resolved, cachedRequisites, "alloc-b")
+
+	require.Len(t, m.roots[hash].allocs, 2)
+
+	// releasing one alloc's reference must not remove the shared root.
+	m.release(hash, "alloc-a")
+	_, _, ok = m.resolve(hash)
+	require.True(t, ok, "root should survive while alloc-b still references it")
+
+	// releasing the last reference removes the GC root symlink.
+	m.release(hash, "alloc-b")
+	_, _, ok = m.resolve(hash)
+	require.False(t, ok, "root should be removed once all allocs release it")
+}
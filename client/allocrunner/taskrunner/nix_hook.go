@@ -9,37 +9,199 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
 	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/allocrunner/interfaces"
+	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/structs"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	// HookNameNix is the name of the Nix hook
 	HookNameNix = "nix"
+
+	// nixOverlayUpperDir and nixOverlayWorkDir are the directory names used
+	// for the overlayfs upperdir/workdir, relative to the alloc dir's
+	// private nix scratch space.
+	nixOverlayUpperDir = "upper"
+	nixOverlayWorkDir  = "work"
+
+	// defaultNixpkgsFlake is used when the client doesn't configure
+	// client.nix.nixpkgs_flake.
+	defaultNixpkgsFlake = "github:NixOS/nixpkgs?rev=aea7242187f21a120fe73b5099c4167e12ec9aab"
+
+	// hostNixStoreDir is the host's Nix store. Requisites are bind-mounted
+	// from here into the task dir at the same path (see mountOverlay) so
+	// that built binaries' RPATH and ELF interpreter entries, which
+	// hard-reference /nix/store/<hash>-<name>/..., keep resolving once
+	// they're in the task's view of the filesystem.
+	hostNixStoreDir = "/nix/store"
 )
 
+// nixSupportedSystems are the `builtins.currentSystem` values the symlinkJoin
+// expression knows how to select legacyPackages for. Anything else is
+// rejected rather than silently mis-evaluated.
+var nixSupportedSystems = map[string]bool{
+	"x86_64-linux":   true,
+	"aarch64-linux":  true,
+	"x86_64-darwin":  true,
+	"aarch64-darwin": true,
+}
+
+// NixConfig is the client.nix config stanza, plumbed down from the agent's
+// client config into each nixHook.
+type NixConfig struct {
+	// NixpkgsFlake is the flake reference used to evaluate symlinkJoin
+	// against, e.g. to build an FHS-like layout for the task dir.
+	NixpkgsFlake string
+
+	// Substituters and TrustedPublicKeys are passed to `nix` as
+	// --option overrides for every build/eval invocation.
+	Substituters      []string
+	TrustedPublicKeys []string
+
+	// GCMinFreeBytes is the free-disk floor under the client data dir
+	// that triggers a `nix-collect-garbage` run. Defaults to
+	// defaultNixGCMinFreeBytes when zero.
+	GCMinFreeBytes int64
+
+	// GCCheckInterval is how often the reaper polls free disk. Defaults
+	// to defaultNixGCCheckInterval when zero.
+	GCCheckInterval time.Duration
+}
+
+// DefaultNixConfig returns the config used when the client doesn't set a
+// client.nix stanza.
+func DefaultNixConfig() *NixConfig {
+	return &NixConfig{NixpkgsFlake: defaultNixpkgsFlake}
+}
+
+// NixConfigFromClient builds a *NixConfig from the agent's decoded
+// client.nix stanza, falling back to DefaultNixConfig when the client
+// config doesn't set one (or leaves nixpkgs_flake empty). This is what the
+// alloc runner's hook constructor should call before passing a config into
+// newNixHook.
+func NixConfigFromClient(c *config.NixConfig) *NixConfig {
+	if c == nil {
+		return DefaultNixConfig()
+	}
+
+	cfg := &NixConfig{
+		NixpkgsFlake:      c.NixpkgsFlake,
+		Substituters:      c.Substituters,
+		TrustedPublicKeys: c.TrustedPublicKeys,
+		GCMinFreeBytes:    c.GCMinFreeBytes,
+		GCCheckInterval:   c.GCCheckInterval,
+	}
+	if cfg.NixpkgsFlake == "" {
+		cfg.NixpkgsFlake = defaultNixpkgsFlake
+	}
+	return cfg
+}
+
+// nixEventEmitter is the slice of *TaskRunner that install() needs to emit
+// task events, narrowed to an interface so tests can drive install() without
+// standing up a full TaskRunner.
+type nixEventEmitter interface {
+	EmitEvent(event *structs.TaskEvent)
+}
+
+// nixRunner is the slice of *TaskRunner that newNixHook needs, narrowed to
+// an interface for the same reason as nixEventEmitter: it lets
+// newNixHook (and in turn NixConfigFromClient's conversion) be exercised in
+// tests without standing up a full TaskRunner.
+type nixRunner interface {
+	nixEventEmitter
+	Alloc() *structs.Allocation
+}
+
 // nixHook is used to prepare a task directory structure based on a Nix flake
 type nixHook struct {
-	alloc    *structs.Allocation
-	runner   *TaskRunner
-	logger   log.Logger
-	firstRun bool
+	alloc     *structs.Allocation
+	runner    nixEventEmitter
+	logger    log.Logger
+	firstRun  bool
+	nixConfig *NixConfig
+	gcroots   *nixGCRootManager
+
+	// buildHash is set once install resolves the shared GC root for this
+	// task's flake, so Stop/Destroy can release the same reference.
+	buildHash string
+
+	// mu guards mounted, mountDir and storeMounted, which are set once the
+	// overlay (and its /nix/store bind mount) are mounted and read back
+	// from Poststop to unmount them.
+	mu           sync.Mutex
+	mounted      bool
+	mountDir     string
+	storeMounted bool
+
+	// storeDir is the host Nix store bind-mounted into the task dir by
+	// mountOverlay. Defaults to hostNixStoreDir in newNixHook; tests
+	// override it to a fake store so they don't depend on a real one
+	// being present on the host running the test.
+	storeDir string
+
+	// The remaining fields wrap the methods install() uses to shell out to
+	// nix/nix-store. They default to the real methods in newNixHook, and
+	// exist as fields (rather than direct method calls) purely so tests can
+	// stub the whole install() path without a real nix binary, e.g. to
+	// assert a shared flake is only actually built once.
+	buildFn       func(flake string, flakeArgs []string, outLink string) error
+	systemFn      func() (string, error)
+	checkSystemFn func(flake string, flakeArgs []string, hostSystem string) error
+	outPathFn     func(flake string, flakeArgs []string) (string, error)
+	requisitesFn  func(outPath string) ([]string, error)
+	symlinkJoinFn func(flake string, flakeArgs []string, system string) (string, error)
 }
 
-func newNixHook(runner *TaskRunner, logger log.Logger) *nixHook {
+// newNixHook builds the nix hook for a task. nixConfig should come from
+// NixConfigFromClient(clientConfig.Nix) so an operator's client.nix stanza
+// (or its absence) is honored; nil falls back to DefaultNixConfig here too
+// so existing callers that haven't been updated keep working.
+func newNixHook(runner nixRunner, logger log.Logger, nixConfig *NixConfig, dataDir string) *nixHook {
+	if nixConfig == nil {
+		nixConfig = DefaultNixConfig()
+	}
+
 	h := &nixHook{
-		alloc:    runner.Alloc(),
-		runner:   runner,
-		firstRun: true,
+		alloc:     runner.Alloc(),
+		runner:    runner,
+		firstRun:  true,
+		nixConfig: nixConfig,
+		storeDir:  hostNixStoreDir,
 	}
 	h.logger = logger.Named(h.Name())
+	h.gcroots = getNixGCRootManager(dataDir, nixConfig, h.logger)
+	h.buildFn = h.nixBuild
+	h.systemFn = h.nixSystem
+	h.checkSystemFn = h.checkDerivationSystem
+	h.outPathFn = h.outPath
+	h.requisitesFn = h.requisites
+	h.symlinkJoinFn = h.symlinkJoin
 	return h
 }
 
+// nixOptionArgs renders the configured substituters/trusted-public-keys as
+// `nix` --option flags, suitable for appending to any nix/nix-store
+// invocation.
+func (h *nixHook) nixOptionArgs() []string {
+	var args []string
+	if len(h.nixConfig.Substituters) > 0 {
+		args = append(args, "--option", "substituters", strings.Join(h.nixConfig.Substituters, " "))
+	}
+	if len(h.nixConfig.TrustedPublicKeys) > 0 {
+		args = append(args, "--option", "trusted-public-keys", strings.Join(h.nixConfig.TrustedPublicKeys, " "))
+	}
+	return args
+}
+
 func (*nixHook) Name() string {
 	return HookNameNix
 }
@@ -70,98 +232,334 @@ func (h *nixHook) Prestart(ctx context.Context, req *interfaces.TaskPrestartRequ
 		return nil
 	}
 
-	configFlakeArgs, ok := req.Task.Config["flake_args"]
-	if ok {
-		flakeArgs, ok := configFlakeArgs.([]string)
-		if ok {
-			return h.install(flake, flakeArgs, req.TaskDir.Dir)
+	flakeArgs := []string{}
+	if configFlakeArgs, ok := req.Task.Config["flake_args"]; ok {
+		if args, ok := configFlakeArgs.([]string); ok {
+			flakeArgs = args
 		}
 	}
 
-	return h.install(flake, []string{}, req.TaskDir.Dir)
+	return h.install(flake, flakeArgs, req.TaskDir)
 }
 
-// install takes a flake URL like:
-// github:NixOS/nixpkgs#cowsay
-// github:NixOS/nixpkgs?ref=nixpkgs-unstable#cowsay
-// github:NixOS/nixpkgs?rev=04b19784342ac2d32f401b52c38a43a1352cd916#cowsay
-//
-// the given flake
-func (h *nixHook) install(flake string, flakeArgs []string, taskDir string) error {
-	_, err := os.Stat(linkPath(flake, flakeArgs, taskDir))
-	if err == nil {
+// Poststop unmounts the overlay that was mounted onto the task directory in
+// install, if one was mounted. It is a no-op when the copy fallback was used
+// instead.
+func (h *nixHook) Poststop(ctx context.Context, req *interfaces.TaskPoststopRequest, resp *interfaces.TaskPoststopResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.mounted {
 		return nil
 	}
 
-	h.logger.Debug("Building flake", "flake", flake)
-	h.emitEvent("Nix", "building flake: "+flake)
+	if h.storeMounted {
+		storeDir := filepath.Join(h.mountDir, "nix", "store")
+		if err := unix.Unmount(storeDir, 0); err != nil {
+			h.logger.Error("failed to unmount nix store bind mount", "dir", storeDir, "error", err)
+			return err
+		}
+		h.storeMounted = false
+	}
 
-	system, err := h.nixSystem()
-	if err != nil {
+	if err := unix.Unmount(h.mountDir, 0); err != nil {
+		h.logger.Error("failed to unmount nix overlay", "dir", h.mountDir, "error", err)
 		return err
 	}
 
-	if err := h.nixBuild(flake, flakeArgs, taskDir); err != nil {
-		return err
+	h.mounted = false
+	return nil
+}
+
+// Stop releases this alloc's reference to the shared nix GC root, if one
+// was acquired during install. The last alloc to release a given build's
+// root unlinks it; the reaper reclaims the store paths later.
+func (h *nixHook) Stop(ctx context.Context, req *interfaces.TaskStopRequest, resp *interfaces.TaskStopResponse) error {
+	h.releaseGCRoot()
+	return nil
+}
+
+// Destroy is the same as Stop, but also fires on GC of a task that never
+// ran Stop (e.g. it failed during Prestart).
+func (h *nixHook) Destroy() error {
+	h.releaseGCRoot()
+	return nil
+}
+
+func (h *nixHook) releaseGCRoot() {
+	if h.buildHash == "" {
+		return
 	}
-	outPath, err := h.outPath(flake, flakeArgs)
+	h.gcroots.release(h.buildHash, h.alloc.ID)
+}
+
+// install takes a flake URL like:
+// github:NixOS/nixpkgs#cowsay
+// github:NixOS/nixpkgs?ref=nixpkgs-unstable#cowsay
+// github:NixOS/nixpkgs?rev=04b19784342ac2d32f401b52c38a43a1352cd916#cowsay
+//
+// and makes it available inside taskDir, preferring an overlayfs mount of
+// the resolved store paths over copying them in.
+func (h *nixHook) install(flake string, flakeArgs []string, taskDir *allocdir.TaskDir) error {
+	dir := taskDir.Dir
+	hash := buildHash(flake, flakeArgs)
+	h.buildHash = hash
+
+	var outPath string
+	var requisites []string
+	var symlinkJoin string
+
+	system, err := h.systemFn()
 	if err != nil {
 		return err
 	}
-	requisites, err := h.requisites(outPath)
-	if err != nil {
+
+	// Reject an architecture mismatch before paying for a build: this only
+	// needs `nix eval`, not the full `nix build`.
+	if err := h.checkSystemFn(flake, flakeArgs, system); err != nil {
+		h.emitEventError("Nix", err)
 		return err
 	}
 
-	taskDirInfo, err := os.Stat(taskDir)
+	if cached, cachedRequisites, ok := h.gcroots.resolve(hash); ok {
+		h.logger.Debug("reusing shared nix build", "flake", flake, "hash", hash)
+		outPath = cached
+
+		if cachedRequisites != nil {
+			requisites = cachedRequisites
+		} else {
+			requisites, err = h.requisitesFn(outPath)
+			if err != nil {
+				return err
+			}
+		}
+		h.gcroots.acquire(hash, outPath, requisites, h.alloc.ID)
+
+		symlinkJoin, err = h.symlinkJoinFn(flake, flakeArgs, system)
+		if err != nil {
+			return err
+		}
+	} else {
+		h.logger.Debug("Building flake", "flake", flake)
+		h.emitEvent("Nix", "building flake: "+flake)
+
+		link, err := h.gcroots.link(hash)
+		if err != nil {
+			return err
+		}
+		if err := h.buildFn(flake, flakeArgs, link); err != nil {
+			return err
+		}
+		outPath, err = h.outPathFn(flake, flakeArgs)
+		if err != nil {
+			return err
+		}
+
+		requisites, err = h.requisitesFn(outPath)
+		if err != nil {
+			return err
+		}
+
+		symlinkJoin, err = h.symlinkJoinFn(flake, flakeArgs, system)
+		if err != nil {
+			return err
+		}
+
+		h.gcroots.acquire(hash, outPath, requisites, h.alloc.ID)
+	}
+
+	taskDirInfo, err := os.Stat(dir)
 	if err != nil {
 		return err
 	}
-
 	uid, gid := getOwner(taskDirInfo)
 
-	// Now copy each dependency into the allocation directory
+	if h.overlaySupported() {
+		if err := h.mountOverlay(taskDir, symlinkJoin, uid, gid); err == nil {
+			return nil
+		} else {
+			h.logger.Warn("overlay mount failed, falling back to copy", "error", err)
+		}
+	} else {
+		h.logger.Debug("overlayfs not available, falling back to copy")
+	}
+
+	return h.installCopy(dir, requisites, symlinkJoin, uid, gid)
+}
+
+// installCopy is the legacy path used when the kernel (or the namespace
+// we're running in) doesn't support overlayfs, e.g. unprivileged user
+// namespaces without the overlay module or a tmpfs-backed alloc dir that
+// rejects upperdir/workdir semantics.
+func (h *nixHook) installCopy(taskDir string, requisites []string, symlinkJoin string, uid, gid int) error {
 	for _, requisit := range requisites {
-		err = filepath.Walk(requisit, copyAll(h.logger, taskDir, false, uid, gid))
-		if err != nil {
+		if err := filepath.Walk(requisit, copyRequisite(h.logger, taskDir, uid, gid)); err != nil {
 			return err
 		}
 	}
 
-	symlinkJoin, err := h.symlinkJoin(flake, flakeArgs, system)
+	return filepath.Walk(symlinkJoin, copyAll(h.logger, symlinkJoin, taskDir, uid, gid))
+}
+
+// overlaySupported does a best-effort check that the running kernel exposes
+// the overlay filesystem. It doesn't guarantee a later mount will succeed
+// (e.g. an unprivileged user namespace may still reject it), but lets us
+// skip straight to the copy fallback in the common case where overlay isn't
+// compiled into the kernel at all.
+func (h *nixHook) overlaySupported() bool {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		// can't tell; let the mount attempt itself decide
+		return true
+	}
+	defer f.Close()
+
+	buf, err := io.ReadAll(f)
 	if err != nil {
+		return true
+	}
+
+	return strings.Contains(string(buf), "overlay")
+}
+
+// mountOverlay assembles an overlayfs out of symlinkJoin (the FHS layout
+// build output) and mounts it read-only onto taskDir.Dir, then bind-mounts
+// the host's Nix store at the same absolute path inside the task dir.
+// upperdir/workdir live under the alloc dir's private nix scratch space so
+// they're cleaned up along with the rest of the allocation.
+//
+// Requisites are deliberately not part of the overlay's lowerdir: each one
+// is itself a /nix/store/<hash>-<name> path, and merging its contents
+// straight onto the task dir root would flatten every requisite's bin/,
+// lib/, share/, etc. into the same few top-level dirs — the same bug
+// copyRequisite avoids in the copy fallback. Bind-mounting /nix/store
+// wholesale keeps every requisite at the absolute path its own (and every
+// other requisite's) RPATH and ELF interpreter entries reference, and at
+// the same path symlinkJoin's own symlinks point at.
+func (h *nixHook) mountOverlay(taskDir *allocdir.TaskDir, symlinkJoin string, uid, gid int) error {
+	scratch := filepath.Join(taskDir.AllocDir, "nix", filepath.Base(taskDir.Dir))
+	upperdir := filepath.Join(scratch, nixOverlayUpperDir)
+	workdir := filepath.Join(scratch, nixOverlayWorkDir)
+
+	for _, dir := range []string{upperdir, workdir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create overlay dir %q: %v", dir, err)
+		}
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown overlay dir %q: %v", dir, err)
+		}
+	}
+
+	// Pre-create the store bind mount's target in the upperdir so it
+	// shows up in the merged view; overlayfs doesn't otherwise know about
+	// a "nix/store" directory that's only mentioned in the bind mount
+	// issued after the overlay itself is mounted.
+	storeDir := filepath.Join(upperdir, "nix", "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		return fmt.Errorf("failed to create overlay store dir %q: %v", storeDir, err)
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", symlinkJoin, upperdir, workdir)
+	if err := unix.Mount("overlay", taskDir.Dir, "overlay", unix.MS_RDONLY, options); err != nil {
+		return fmt.Errorf("failed to mount nix overlay onto %q: %v", taskDir.Dir, err)
+	}
+
+	h.mu.Lock()
+	h.mounted = true
+	h.mountDir = taskDir.Dir
+	h.mu.Unlock()
+
+	if err := h.bindMountNixStore(taskDir.Dir); err != nil {
+		if unmountErr := unix.Unmount(taskDir.Dir, 0); unmountErr != nil {
+			h.logger.Error("failed to unmount nix overlay after failed store bind mount", "dir", taskDir.Dir, "error", unmountErr)
+		}
+		h.mu.Lock()
+		h.mounted = false
+		h.mu.Unlock()
 		return err
 	}
 
-	return filepath.Walk(symlinkJoin, copyAll(h.logger, taskDir, true, uid, gid))
+	return nil
+}
+
+// bindMountNixStore bind-mounts the host's Nix store read-only onto
+// taskDir's nix/store, so requisites resolve at the same absolute path
+// inside the task as they do on the host.
+func (h *nixHook) bindMountNixStore(taskDir string) error {
+	storeDir := filepath.Join(taskDir, "nix", "store")
+
+	if err := unix.Mount(h.storeDir, storeDir, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %q onto %q: %v", h.storeDir, storeDir, err)
+	}
+	if err := unix.Mount("", storeDir, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("failed to remount %q read-only: %v", storeDir, err)
+	}
+
+	h.mu.Lock()
+	h.storeMounted = true
+	h.mu.Unlock()
+
+	return nil
 }
 
 func (h *nixHook) nixSystem() (string, error) {
 	// First we build the derivation to make sure all paths are in the host store
 	cmd := exec.Command("nix", "eval", "--raw", "--impure", "--expr", "builtins.currentSystem")
 	output, err := cmd.CombinedOutput()
-	currentSystem := string(output)
+	currentSystem := strings.TrimSpace(string(output))
 	h.logger.Debug(cmd.String(), "output", currentSystem)
 	if err != nil {
 		h.logger.Error(cmd.String(), "output", currentSystem, "error", err)
 		return "", err
 	}
+
+	if !nixSupportedSystems[currentSystem] {
+		return "", fmt.Errorf("unsupported nix system %q", currentSystem)
+	}
+
 	return currentSystem, nil
 }
 
-func linkPath(flake string, flakeArgs []string, taskDir string) string {
+// checkDerivationSystem makes sure the flake's derivation targets the host's
+// system, rather than failing opaquely mid-build (or worse, producing a
+// cross-built binary nix happily installs but that won't execute).
+func (h *nixHook) checkDerivationSystem(flake string, flakeArgs []string, hostSystem string) error {
+	args := append(append([]string{"eval", "--raw", "--apply", "(pkg: pkg.system)"}, h.nixOptionArgs()...), flakeArgs...)
+	args = append(args, flake)
+	cmd := exec.Command("nix", args...)
+	output, err := cmd.Output()
+	derivationSystem := strings.TrimSpace(string(output))
+	h.logger.Debug(cmd.String(), "output", derivationSystem)
+	if err != nil {
+		// not every derivation exposes `system` (e.g. fixed-output
+		// derivations); don't fail the build over a best-effort check.
+		h.logger.Debug("could not determine derivation system, skipping check", "flake", flake, "error", err)
+		return nil
+	}
+
+	if derivationSystem != hostSystem {
+		return fmt.Errorf("flake %q builds for system %q, but this client is %q", flake, derivationSystem, hostSystem)
+	}
+
+	return nil
+}
+
+// buildHash identifies a (flake, flakeArgs) pair, used both as the shared
+// GC root's file name and as the cache key in nixGCRootManager.
+func buildHash(flake string, flakeArgs []string) string {
 	parts := []byte(flake)
 	for _, part := range flakeArgs {
 		parts = append(parts, []byte(part)...)
 	}
 
-	hash := fmt.Sprintf("%x", sha256.Sum256(parts))
-	return filepath.Join(taskDir, hash)
+	return fmt.Sprintf("%x", sha256.Sum256(parts))
 }
 
-// nixBuild ensures all requisites are present in the host Nix store.
-func (h *nixHook) nixBuild(flake string, flakeArgs []string, taskDir string) error {
-	args := []string{"build", "--out-link", linkPath(flake, flakeArgs, taskDir)}
+// nixBuild ensures all requisites are present in the host Nix store,
+// recording the shared GC root at outLink.
+func (h *nixHook) nixBuild(flake string, flakeArgs []string, outLink string) error {
+	args := []string{"build", "--out-link", outLink}
+	args = append(args, h.nixOptionArgs()...)
 	args = append(append(args, flakeArgs...), flake)
 	cmd := exec.Command("nix", args...)
 	nixBuildOutput, err := cmd.Output()
@@ -181,6 +579,7 @@ func (h *nixHook) nixBuild(flake string, flakeArgs []string, taskDir string) err
 func (h *nixHook) outPath(flake string, flakeArgs []string) (string, error) {
 	// Then get the path to the derivation output
 	args := []string{"eval", "--raw", "--apply", "(pkg: pkg.outPath)"}
+	args = append(args, h.nixOptionArgs()...)
 	args = append(append(args, flakeArgs...), flake)
 	cmd := exec.Command("nix", args...)
 	nixEvalOutput, err := cmd.Output()
@@ -215,14 +614,16 @@ func (h *nixHook) requisites(outPath string) ([]string, error) {
 	return strings.Fields(string(nixStoreOutput)), nil
 }
 
-// TODO: choose correct architecture, atm this only works on x86_64-linux
 // This uses the nixpkgs symlinkJoin derivation to build a directory that
-// looks like normal FHS, e.g. /bin /share /etc and the like.
+// looks like normal FHS, e.g. /bin /share /etc and the like. The nixpkgs
+// flake is configurable via client.nix.nixpkgs_flake, and system has
+// already been validated by nixSystem against nixSupportedSystems so it's
+// safe to interpolate.
 func (h *nixHook) symlinkJoin(flake string, flakeArgs []string, system string) (string, error) {
 	expr := `
 	let
 		pkgs = builtins.getFlake
-			"github:NixOS/nixpkgs?rev=aea7242187f21a120fe73b5099c4167e12ec9aab";
+			"` + h.nixConfig.NixpkgsFlake + `";
 	in pkg:
 	let
 		sym = pkgs.legacyPackages.` + system + `.symlinkJoin {
@@ -233,6 +634,7 @@ func (h *nixHook) symlinkJoin(flake string, flakeArgs []string, system string) (
 	`
 
 	args := []string{"eval", "--raw", flake}
+	args = append(args, h.nixOptionArgs()...)
 	args = append(append(args, flakeArgs...), "--apply", expr)
 	cmd := exec.Command("nix", args...)
 	symlinkOutput, err := cmd.Output()
@@ -250,18 +652,44 @@ func (h *nixHook) symlinkJoin(flake string, flakeArgs []string, system string) (
 	return output, nil
 }
 
-func copyAll(logger hclog.Logger, targetDir string, truncate bool, uid, gid int) filepath.WalkFunc {
+// copyAll walks srcRoot (the symlinkJoin FHS directory) and recreates its
+// contents under targetDir, with destination paths computed relative to
+// srcRoot so the join's bin/, lib/, share/, etc. land directly under
+// targetDir rather than nested under its own store path.
+func copyAll(logger hclog.Logger, srcRoot, targetDir string, uid, gid int) filepath.WalkFunc {
+	return copyWith(logger, targetDir, uid, gid, func(path string) (string, error) {
+		rel, err := filepath.Rel(srcRoot, path)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(targetDir, rel), nil
+	})
+}
+
+// copyRequisite walks a single nix store requisite (e.g.
+// /nix/store/<hash>-<name>) and recreates it under targetDir preserving its
+// full store path, so that each requisite lands in its own
+// /nix/store/<hash>-<name>/... subtree instead of being flattened together
+// with every other requisite's bin/, lib/, share/, etc. Binaries built
+// against the store hard-reference these full paths via RPATH and the ELF
+// interpreter, so they must survive the copy fallback unchanged.
+func copyRequisite(logger hclog.Logger, targetDir string, uid, gid int) filepath.WalkFunc {
+	return copyWith(logger, targetDir, uid, gid, func(path string) (string, error) {
+		return filepath.Join(targetDir, path), nil
+	})
+}
+
+// copyWith walks a directory, handing each visited path to dstFor to compute
+// the corresponding destination under targetDir before recreating it there.
+func copyWith(logger hclog.Logger, targetDir string, uid, gid int, dstFor func(path string) (string, error)) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		var dst string
-		if truncate {
-			parts := splitPath(path)
-			dst = filepath.Join(append([]string{targetDir}, parts[3:]...)...)
-		} else {
-			dst = filepath.Join(targetDir, path)
+		dst, err := dstFor(path)
+		if err != nil {
+			return err
 		}
 
 		// Skip the file if it already exists at the dst
@@ -335,13 +763,3 @@ func getOwner(fi os.FileInfo) (int, int) {
 	return int(stat.Uid), int(stat.Gid)
 }
 
-// SplitPath splits a file path into its directories and filename.
-func splitPath(path string) []string {
-	dir := filepath.Dir(path)
-	base := filepath.Base(path)
-	if dir == "/" {
-		return []string{base}
-	} else {
-		return append(splitPath(dir), base)
-	}
-}
@@ -0,0 +1,193 @@
+package taskrunner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// noopEventEmitter discards task events, standing in for a *TaskRunner in
+// tests that only exercise nixHook.install().
+type noopEventEmitter struct{}
+
+func (noopEventEmitter) EmitEvent(event *structs.TaskEvent) {}
+
+// fakeNixRunner stands in for a *TaskRunner in tests that exercise
+// newNixHook itself, since nixRunner only needs Alloc() and EmitEvent().
+type fakeNixRunner struct {
+	noopEventEmitter
+	alloc *structs.Allocation
+}
+
+func (r fakeNixRunner) Alloc() *structs.Allocation { return r.alloc }
+
+// newTestNixHook builds a nixHook with every nix/nix-store subprocess call
+// stubbed out, sharing gcroots across hooks built from the same manager so
+// install() can be exercised without a real `nix` binary.
+func newTestNixHook(allocID string, gcroots *nixGCRootManager, buildFn func(flake string, flakeArgs []string, outLink string) error, storeDir string) *nixHook {
+	h := &nixHook{
+		alloc:   &structs.Allocation{ID: allocID},
+		runner:  noopEventEmitter{},
+		logger:  hclog.NewNullLogger(),
+		gcroots: gcroots,
+	}
+	h.buildFn = buildFn
+	h.systemFn = func() (string, error) { return "x86_64-linux", nil }
+	h.checkSystemFn = func(flake string, flakeArgs []string, hostSystem string) error { return nil }
+	h.outPathFn = func(flake string, flakeArgs []string) (string, error) { return storeDir, nil }
+	h.requisitesFn = func(outPath string) ([]string, error) { return []string{storeDir}, nil }
+	h.symlinkJoinFn = func(flake string, flakeArgs []string, system string) (string, error) { return storeDir, nil }
+	return h
+}
+
+func newTestTaskDir(t *testing.T) *allocdir.TaskDir {
+	allocDir := t.TempDir()
+	dir := filepath.Join(allocDir, "task")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	return &allocdir.TaskDir{Dir: dir, AllocDir: allocDir}
+}
+
+// TestNixHook_InstallSharesBuildAcrossTasks simulates two tasks installing
+// the same flake: the second install must resolve the first's shared GC
+// root rather than invoking nixBuild again.
+func TestNixHook_InstallSharesBuildAcrossTasks(t *testing.T) {
+	storeDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(storeDir, "bin"), []byte("fake output"), 0755))
+
+	gcroots := newNixGCRootManager(t.TempDir(), DefaultNixConfig(), hclog.NewNullLogger())
+
+	var builds int
+	buildFn := func(flake string, flakeArgs []string, outLink string) error {
+		builds++
+		return os.Symlink(storeDir, outLink)
+	}
+
+	const flake = "github:example/flake#pkg"
+
+	hookA := newTestNixHook("alloc-a", gcroots, buildFn, storeDir)
+	require.NoError(t, hookA.install(flake, nil, newTestTaskDir(t)))
+
+	hookB := newTestNixHook("alloc-b", gcroots, buildFn, storeDir)
+	require.NoError(t, hookB.install(flake, nil, newTestTaskDir(t)))
+
+	require.Equal(t, 1, builds, "second install of the same flake should reuse the shared build instead of running it again")
+}
+
+// TestCopyRequisite_PreservesFullStorePath guards against flattening
+// multiple requisites into the same top-level dirs: two requisites that
+// each ship their own lib/libc.so must land at distinct destinations under
+// targetDir, keeping the full /nix/store/<hash>-<name>/... path the way
+// installed binaries' RPATH and ELF interpreter entries expect.
+func TestCopyRequisite_PreservesFullStorePath(t *testing.T) {
+	root := t.TempDir()
+	storeA := filepath.Join(root, "nix", "store", "aaa-foo")
+	storeB := filepath.Join(root, "nix", "store", "bbb-bar")
+	require.NoError(t, os.MkdirAll(filepath.Join(storeA, "lib"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(storeB, "lib"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(storeA, "lib", "libc.so"), []byte("foo's libc"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(storeB, "lib", "libc.so"), []byte("bar's libc"), 0644))
+
+	targetDir := t.TempDir()
+	require.NoError(t, filepath.Walk(storeA, copyRequisite(hclog.NewNullLogger(), targetDir, -1, -1)))
+	require.NoError(t, filepath.Walk(storeB, copyRequisite(hclog.NewNullLogger(), targetDir, -1, -1)))
+
+	fooLibc, err := os.ReadFile(filepath.Join(targetDir, storeA, "lib", "libc.so"))
+	require.NoError(t, err)
+	require.Equal(t, "foo's libc", string(fooLibc))
+
+	barLibc, err := os.ReadFile(filepath.Join(targetDir, storeB, "lib", "libc.so"))
+	require.NoError(t, err)
+	require.Equal(t, "bar's libc", string(barLibc))
+}
+
+// TestNewNixHook_HonorsClientConfig exercises the real call path an alloc
+// runner hook constructor is expected to use: a parsed client.nix stanza
+// goes through NixConfigFromClient into newNixHook, and the resulting hook
+// must actually use it, not the built-in default.
+func TestNewNixHook_HonorsClientConfig(t *testing.T) {
+	clientCfg := &config.NixConfig{
+		NixpkgsFlake:      "github:example/nixpkgs?rev=deadbeef",
+		Substituters:      []string{"https://cache.example.com"},
+		TrustedPublicKeys: []string{"example:abc123="},
+		GCMinFreeBytes:    1 << 30,
+	}
+
+	runner := fakeNixRunner{alloc: &structs.Allocation{ID: "alloc-a"}}
+	h := newNixHook(runner, hclog.NewNullLogger(), NixConfigFromClient(clientCfg), t.TempDir())
+
+	require.Equal(t, clientCfg.NixpkgsFlake, h.nixConfig.NixpkgsFlake)
+	require.Equal(t, clientCfg.Substituters, h.nixConfig.Substituters)
+	require.Equal(t, clientCfg.TrustedPublicKeys, h.nixConfig.TrustedPublicKeys)
+	require.Equal(t, clientCfg.GCMinFreeBytes, h.nixConfig.GCMinFreeBytes)
+	require.Equal(t, []string{
+		"--option", "substituters", "https://cache.example.com",
+		"--option", "trusted-public-keys", "example:abc123=",
+	}, h.nixOptionArgs())
+}
+
+// TestNewNixHook_DefaultsWithoutClientConfig covers the no-stanza case: an
+// operator who never set client.nix should still get a working hook built
+// from NixConfigFromClient(nil), not a nil nixConfig that panics later.
+func TestNewNixHook_DefaultsWithoutClientConfig(t *testing.T) {
+	runner := fakeNixRunner{alloc: &structs.Allocation{ID: "alloc-a"}}
+	h := newNixHook(runner, hclog.NewNullLogger(), NixConfigFromClient(nil), t.TempDir())
+
+	require.Equal(t, defaultNixpkgsFlake, h.nixConfig.NixpkgsFlake)
+	require.Empty(t, h.nixOptionArgs())
+}
+
+// TestNixHook_MountOverlayPreservesStorePaths guards against the overlay
+// path flattening requisites the way copyRequisite guards the copy
+// fallback: a requisite's absolute /nix/store/<hash>-<name>/... path must
+// still resolve from inside the mounted task dir, not just wherever
+// symlinkJoin's FHS layer happens to land it. Needs root for the actual
+// mount(2) calls, so it's skipped otherwise.
+func TestNixHook_MountOverlayPreservesStorePaths(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting overlayfs and bind mounts requires root")
+	}
+
+	// fakeStore stands in for the host's real /nix/store: h.storeDir is
+	// overridden to it so the test doesn't depend on (or mutate) whatever
+	// store is actually on the machine running it. Its layout, and the
+	// absolute /nix/store/... paths referenced below, mirror what a real
+	// store and symlinkJoin output look like once fakeStore is bind
+	// mounted onto taskDir's nix/store.
+	fakeStore := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(fakeStore, "abc-foo", "lib"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(fakeStore, "abc-foo", "lib", "libfoo.so"), []byte("foo"), 0644))
+
+	symlinkJoin := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(symlinkJoin, "lib"), 0755))
+	require.NoError(t, os.Symlink("/nix/store/abc-foo/lib/libfoo.so", filepath.Join(symlinkJoin, "lib", "libfoo.so")))
+
+	taskDir := newTestTaskDir(t)
+	taskDirInfo, err := os.Stat(taskDir.Dir)
+	require.NoError(t, err)
+	uid, gid := getOwner(taskDirInfo)
+
+	h := &nixHook{logger: hclog.NewNullLogger(), storeDir: fakeStore}
+	require.NoError(t, h.mountOverlay(taskDir, symlinkJoin, uid, gid))
+	defer func() {
+		require.NoError(t, unix.Unmount(filepath.Join(taskDir.Dir, "nix", "store"), 0))
+		require.NoError(t, unix.Unmount(taskDir.Dir, 0))
+	}()
+
+	// The requisite must resolve at its real absolute path under the
+	// mounted task dir, so symlinkJoin's own symlink (which points at that
+	// absolute path) isn't dangling.
+	content, err := os.ReadFile(filepath.Join(taskDir.Dir, "nix", "store", "abc-foo", "lib", "libfoo.so"))
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(content))
+
+	linkTarget, err := os.Readlink(filepath.Join(taskDir.Dir, "lib", "libfoo.so"))
+	require.NoError(t, err)
+	require.Equal(t, "/nix/store/abc-foo/lib/libfoo.so", linkTarget)
+}
@@ -0,0 +1,31 @@
+package config
+
+import "time"
+
+// NixConfig is the client.nix config stanza, decoded from the agent's HCL
+// or JSON client config. It's converted to a
+// *taskrunner.NixConfig via taskrunner.NixConfigFromClient when task hooks
+// are built, so this package doesn't need to know about the nix hook's
+// internals.
+type NixConfig struct {
+	// NixpkgsFlake is client.nix.nixpkgs_flake: the flake reference used
+	// to evaluate symlinkJoin against. Defaults to the hook's built-in
+	// pinned nixpkgs when unset.
+	NixpkgsFlake string `hcl:"nixpkgs_flake"`
+
+	// Substituters and TrustedPublicKeys are client.nix.substituters and
+	// client.nix.trusted_public_keys, passed to `nix` as --option
+	// overrides for every build/eval invocation.
+	Substituters      []string `hcl:"substituters"`
+	TrustedPublicKeys []string `hcl:"trusted_public_keys"`
+
+	// GCMinFreeBytes is client.nix.gc_min_free_bytes: the free-disk floor
+	// under the client data dir that triggers a `nix-collect-garbage`
+	// run. Defaults to the hook's built-in threshold when zero.
+	GCMinFreeBytes int64 `hcl:"gc_min_free_bytes"`
+
+	// GCCheckInterval is client.nix.gc_check_interval: how often the
+	// reaper polls free disk. Defaults to the hook's built-in interval
+	// when zero.
+	GCCheckInterval time.Duration `hcl:"gc_check_interval"`
+}
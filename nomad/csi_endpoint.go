@@ -0,0 +1,53 @@
+package nomad
+
+import (
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// CSIVolume is the server RPC endpoint for CSI volume operations. Only the
+// method needed to back ClaimUpdateRPC is defined here; the rest of the
+// endpoint (Get/List/Register/Deregister/Claim) lives alongside it in the
+// full server package.
+type CSIVolume struct {
+	srv *Server
+}
+
+// UpsertVolumeClaims applies a batch of claim state updates in a single
+// Raft apply. It backs volumewatcher.ClaimUpdateRPC for the
+// volumewatcher's volumeUpdateBatcher, which coalesces a burst of claim
+// releases (e.g. a job with thousands of volumes being stopped) into one
+// log entry instead of one per volume.
+func (v *CSIVolume) UpsertVolumeClaims(args *structs.CSIVolumeClaimBatchRequest, reply *structs.CSIVolumeClaimBatchResponse) error {
+	defer metrics.MeasureSince([]string{"nomad", "volume", "upsert_claims"}, time.Now())
+
+	if done, err := v.srv.forward("CSIVolume.UpsertVolumeClaims", args, args, reply); done {
+		return err
+	}
+
+	if len(args.Claims) == 0 {
+		return nil
+	}
+
+	_, index, err := v.srv.raftApply(structs.CSIVolumeClaimBatchRequestType, args)
+	if err != nil {
+		return err
+	}
+
+	reply.Index = index
+	return nil
+}
+
+// UpsertVolumeClaims lets the volumewatcher's update batcher call directly
+// into this server instead of going through the client RPC transport,
+// satisfying volumewatcher.ClaimUpdateRPC.
+func (s *Server) UpsertVolumeClaims(batch *structs.CSIVolumeClaimBatchRequest) (uint64, error) {
+	reply := &structs.CSIVolumeClaimBatchResponse{}
+	if err := s.staticEndpoints.CSIVolume.UpsertVolumeClaims(batch, reply); err != nil {
+		return 0, err
+	}
+	return reply.Index, nil
+}
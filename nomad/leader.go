@@ -0,0 +1,25 @@
+package nomad
+
+import "github.com/hashicorp/nomad/nomad/volumewatcher"
+
+// establishVolumeWatcher starts (or restarts) the CSI volume claim
+// reconciler on leadership transfer. It's called from the leader loop
+// alongside the server's other per-leader watchers.
+func (s *Server) establishVolumeWatcher() {
+	if s.volumeWatcher == nil {
+		s.volumeWatcher = volumewatcher.NewVolumesWatcher(
+			s.logger, s, s,
+			volumewatcher.LimitStateQueriesPerSecond,
+			volumewatcher.CrossVolumeUpdateBatchDuration,
+		)
+	}
+	s.volumeWatcher.SetEnabled(true, s.State())
+}
+
+// revokeVolumeWatcher stops the CSI volume claim reconciler on leadership
+// loss so a former leader doesn't keep issuing detach RPCs.
+func (s *Server) revokeVolumeWatcher() {
+	if s.volumeWatcher != nil {
+		s.volumeWatcher.SetEnabled(false, nil)
+	}
+}
@@ -0,0 +1,18 @@
+package structs
+
+// CSIVolumeClaimBatchRequest batches the claim updates for many volumes
+// into a single RPC, so a burst of releases (e.g. stopping a job that
+// claims thousands of volumes) produces one Raft apply instead of one per
+// volume. It's consumed by the CSIVolume.UpsertVolumeClaims RPC, which the
+// volumewatcher's update batcher calls through the ClaimUpdateRPC
+// interface (see nomad/volumewatcher/interfaces.go).
+type CSIVolumeClaimBatchRequest struct {
+	Claims []CSIVolumeClaimRequest
+	WriteRequest
+}
+
+// CSIVolumeClaimBatchResponse reports the Raft index the batch was applied
+// at, mirroring the single-claim CSIVolumeClaimResponse.
+type CSIVolumeClaimBatchResponse struct {
+	WriteMeta
+}
@@ -0,0 +1,29 @@
+package structs
+
+// MessageType is the Raft log entry type, used by the FSM to dispatch an
+// applied log entry to the right apply handler. New message types must
+// always be appended to the end of the const block below (never inserted
+// or renumbered), so that a Raft log written by an older binary still
+// decodes to the same type once replayed by a newer one.
+type MessageType uint8
+
+const (
+	NodeRegisterRequestType MessageType = iota
+	NodeDeregisterRequestType
+	NodeUpdateStatusRequestType
+	NodeUpdateDrainRequestType
+	JobRegisterRequestType
+	JobDeregisterRequestType
+	EvalUpdateRequestType
+	EvalDeleteRequestType
+	AllocUpdateRequestType
+	AllocClientUpdateRequestType
+	CSIVolumeRegisterRequestType
+	CSIVolumeDeregisterRequestType
+	CSIVolumeClaimRequestType
+
+	// CSIVolumeClaimBatchRequestType is the Raft log entry type for a
+	// CSIVolumeClaimBatchRequest, applied once per flush of the
+	// server-side claim update batcher instead of once per claim.
+	CSIVolumeClaimBatchRequestType
+)
@@ -0,0 +1,81 @@
+package volumewatcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// CrossVolumeUpdateBatchDuration is the default window used to coalesce
+// claim updates for many volumes into a single Raft apply.
+const CrossVolumeUpdateBatchDuration = 250 * time.Millisecond
+
+// volumeUpdateBatcher collects claim updates for a window of
+// batchDuration and flushes them as a single UpsertVolumeClaims call. The
+// Watcher creates one in SetEnabled and routes every claim update through
+// it, wrapping its ClaimUpdateRPC, so that a burst of claim releases (e.g. a job with thousands of volumes being
+// stopped) doesn't produce a Raft apply per volume.
+type volumeUpdateBatcher struct {
+	batchDuration time.Duration
+	rpc           ClaimUpdateRPC
+
+	mu      sync.Mutex
+	pending []structs.CSIVolumeClaimRequest
+	waiters []chan error
+	timer   *time.Timer
+}
+
+// NewVolumeUpdateBatcher creates a batcher that flushes accumulated claim
+// updates to rpc every batchDuration, or immediately once ctx is canceled.
+func NewVolumeUpdateBatcher(ctx context.Context, batchDuration time.Duration, rpc ClaimUpdateRPC) *volumeUpdateBatcher {
+	b := &volumeUpdateBatcher{
+		batchDuration: batchDuration,
+		rpc:           rpc,
+	}
+
+	go func() {
+		<-ctx.Done()
+		b.flush()
+	}()
+
+	return b
+}
+
+// Add enqueues a claim update and blocks until it's been flushed.
+func (b *volumeUpdateBatcher) Add(claim structs.CSIVolumeClaimRequest) error {
+	b.mu.Lock()
+	b.pending = append(b.pending, claim)
+	waitCh := make(chan error, 1)
+	b.waiters = append(b.waiters, waitCh)
+
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.batchDuration, b.flush)
+	}
+	b.mu.Unlock()
+
+	return <-waitCh
+}
+
+func (b *volumeUpdateBatcher) flush() {
+	b.mu.Lock()
+	claims := b.pending
+	waiters := b.waiters
+	b.pending = nil
+	b.waiters = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	if len(claims) == 0 {
+		return
+	}
+
+	_, err := b.rpc.UpsertVolumeClaims(&structs.CSIVolumeClaimBatchRequest{Claims: claims})
+	for _, w := range waiters {
+		w <- err
+	}
+}
@@ -0,0 +1,27 @@
+package volumewatcher
+
+import (
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// VolumeRPC is the RPC surface the watcher needs in order to tell CSI
+// plugins to detach a volume. In production this is implemented by the
+// Nomad server (see nomad/csi_endpoint.go); tests provide a mock.
+type VolumeRPC interface {
+	ControllerDetachVolume(*structs.ClientCSIControllerDetachVolumeRequest, *structs.ClientCSIControllerDetachVolumeResponse) error
+	NodeDetachVolume(*structs.ClientCSINodeDetachVolumeRequest, *structs.ClientCSINodeDetachVolumeResponse) error
+}
+
+// ClaimUpdateRPC persists a batch of claim updates back to the state store.
+// It's implemented by the Nomad server, which applies each batch as one Raft
+// entry; the watcher calls it through its own volumeUpdateBatcher, which
+// coalesces concurrent claim updates into one batch.
+type ClaimUpdateRPC interface {
+	UpsertVolumeClaims(*structs.CSIVolumeClaimBatchRequest) (uint64, error)
+}
+
+// RPC is the full surface required by NewVolumesWatcher.
+type RPC interface {
+	VolumeRPC
+	ClaimUpdateRPC
+}
@@ -0,0 +1,58 @@
+package volumewatcher
+
+import (
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Metrics are emitted through go-metrics, consistent with the rest of the
+// server's metrics surface; the configured telemetry sink (statsd, dogstatsd,
+// Prometheus, ...) determines how they're ultimately exposed. When
+// Prometheus is enabled these surface as
+// nomad_nomad_volumewatcher_active_watchers, _detach_total, and
+// _time_to_release respectively.
+var (
+	metricsActiveWatchers = []string{"nomad", "volumewatcher", "active_watchers"}
+	metricsDetachTotal    = []string{"nomad", "volumewatcher", "detach_total"}
+	metricsTimeToRelease  = []string{"nomad", "volumewatcher", "time_to_release"}
+)
+
+func recordWatcherStarted(namespace string) {
+	metrics.IncrCounterWithLabels([]string{"nomad", "volumewatcher", "watchers_started"}, 1,
+		[]metrics.Label{{Name: "namespace", Value: namespace}})
+}
+
+func recordWatcherStopped(namespace string) {
+	metrics.IncrCounterWithLabels([]string{"nomad", "volumewatcher", "watchers_stopped"}, 1,
+		[]metrics.Label{{Name: "namespace", Value: namespace}})
+}
+
+func recordDetachSuccess(namespace, plugin string) {
+	metrics.IncrCounterWithLabels(metricsDetachTotal, 1, []metrics.Label{
+		{Name: "namespace", Value: namespace},
+		{Name: "plugin_id", Value: plugin},
+		{Name: "result", Value: "success"},
+	})
+}
+
+func recordDetachFailure(namespace, plugin string) {
+	metrics.IncrCounterWithLabels(metricsDetachTotal, 1, []metrics.Label{
+		{Name: "namespace", Value: namespace},
+		{Name: "plugin_id", Value: plugin},
+		{Name: "result", Value: "failure"},
+	})
+}
+
+// recordTimeToRelease samples the duration between a claim first needing
+// release and the detach RPC that finally frees it.
+func recordTimeToRelease(namespace string, d time.Duration) {
+	metrics.AddSampleWithLabels(metricsTimeToRelease, float32(d.Milliseconds()),
+		[]metrics.Label{{Name: "namespace", Value: namespace}})
+}
+
+// recordActiveWatchers reports the current count of in-memory volume
+// watchers as a gauge, so operators can see reconciliation backlog size.
+func recordActiveWatchers(count int) {
+	metrics.SetGauge(metricsActiveWatchers, float32(count))
+}
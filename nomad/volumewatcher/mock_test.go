@@ -0,0 +1,145 @@
+package volumewatcher
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// MockRPCServer is a stand-in for the Nomad server RPC surface used by the
+// tests that only care about watcher registration, not the detach RPCs
+// themselves.
+type MockRPCServer struct {
+	state *state.StateStore
+}
+
+func (srv *MockRPCServer) State() *state.StateStore { return srv.state }
+
+func (srv *MockRPCServer) ControllerDetachVolume(
+	req *structs.ClientCSIControllerDetachVolumeRequest,
+	resp *structs.ClientCSIControllerDetachVolumeResponse) error {
+	return nil
+}
+
+func (srv *MockRPCServer) NodeDetachVolume(
+	req *structs.ClientCSINodeDetachVolumeRequest,
+	resp *structs.ClientCSINodeDetachVolumeResponse) error {
+	return nil
+}
+
+func (srv *MockRPCServer) UpsertVolumeClaims(req *structs.CSIVolumeClaimBatchRequest) (uint64, error) {
+	index, err := srv.state.LatestIndex()
+	if err != nil {
+		return 0, err
+	}
+	index++
+
+	for _, c := range req.Claims {
+		claim := &structs.CSIVolumeClaim{
+			AllocationID: c.AllocationID,
+			NodeID:       c.NodeID,
+			Mode:         c.Claim,
+			State:        c.State,
+		}
+		if err := srv.state.CSIVolumeClaim(index, c.Namespace, c.VolumeID, claim); err != nil {
+			return 0, err
+		}
+	}
+	return index, nil
+}
+
+// MockStatefulRPCServer extends MockRPCServer with call counters, injectable
+// controller detach failures, and a volumeUpdateBatcher field that tests
+// set; UpsertVolumeClaims doesn't route through that field and writes each
+// batch straight to the state store.
+type MockStatefulRPCServer struct {
+	MockRPCServer
+
+	volumeUpdateBatcher *volumeUpdateBatcher
+
+	mu                             sync.Mutex
+	countCSIControllerDetachVolume int
+	countCSINodeDetachVolume       int
+	countUpsertVolumeClaims        int
+	failCSIControllerDetachVolumeN int
+}
+
+func (srv *MockStatefulRPCServer) ControllerDetachVolume(
+	req *structs.ClientCSIControllerDetachVolumeRequest,
+	resp *structs.ClientCSIControllerDetachVolumeResponse) error {
+
+	srv.mu.Lock()
+	srv.countCSIControllerDetachVolume++
+	if srv.failCSIControllerDetachVolumeN > 0 {
+		srv.failCSIControllerDetachVolumeN--
+		srv.mu.Unlock()
+		return fmt.Errorf("injected controller detach failure")
+	}
+	srv.mu.Unlock()
+	return nil
+}
+
+func (srv *MockStatefulRPCServer) NodeDetachVolume(
+	req *structs.ClientCSINodeDetachVolumeRequest,
+	resp *structs.ClientCSINodeDetachVolumeResponse) error {
+
+	srv.mu.Lock()
+	srv.countCSINodeDetachVolume++
+	srv.mu.Unlock()
+	return nil
+}
+
+func (srv *MockStatefulRPCServer) UpsertVolumeClaims(req *structs.CSIVolumeClaimBatchRequest) (uint64, error) {
+	srv.mu.Lock()
+	srv.countUpsertVolumeClaims++
+	srv.mu.Unlock()
+	return srv.MockRPCServer.UpsertVolumeClaims(req)
+}
+
+// testNode registers (or extends) a node advertising plugin as both a
+// controller and node plugin, and returns it.
+func testNode(node *structs.Node, plugin *structs.CSIPlugin, s *state.StateStore) *structs.Node {
+	if node == nil {
+		node = mock.Node()
+	}
+
+	node.CSIControllerPlugins = map[string]*structs.CSIInfo{
+		plugin.ID: {
+			PluginID:                 plugin.ID,
+			Healthy:                  true,
+			RequiresControllerPlugin: true,
+			ControllerInfo: &structs.CSIControllerInfo{
+				SupportsAttachDetach: true,
+			},
+		},
+	}
+	node.CSINodePlugins = map[string]*structs.CSIInfo{
+		plugin.ID: {
+			PluginID: plugin.ID,
+			Healthy:  true,
+		},
+	}
+
+	index, _ := s.LatestIndex()
+	index++
+	if err := s.UpsertNode(index, node); err != nil {
+		panic(err)
+	}
+
+	return node
+}
+
+// testVolume returns a CSIVolume claimed (read-only) by alloc, extending vol
+// if one is passed in. nodeID is not used.
+func testVolume(vol *structs.CSIVolume, plugin *structs.CSIPlugin, alloc *structs.Allocation, nodeID string) *structs.CSIVolume {
+	if vol == nil {
+		vol = mock.CSIVolume(plugin)
+	}
+
+	vol.ReadAllocs = map[string]*structs.Allocation{alloc.ID: alloc}
+
+	return vol
+}
@@ -0,0 +1,103 @@
+package volumewatcher
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// reconcileQueue is a min-heap of volumeReconcileEntry ordered by due time,
+// shared by the Watcher's single reconciler goroutine and whatever notifies
+// it of new or changed volumes. The Watcher keeps exactly one
+// reconcileQueue, replacing one goroutine (and one memdb watch) per volume
+// with one shared queue for every volume across every controller plugin.
+type reconcileQueue struct {
+	mu    sync.Mutex
+	items []*volumeReconcileEntry
+	wake  chan struct{}
+}
+
+func newReconcileQueue() *reconcileQueue {
+	q := &reconcileQueue{wake: make(chan struct{}, 1)}
+	heap.Init(q)
+	return q
+}
+
+func (q *reconcileQueue) Len() int { return len(q.items) }
+func (q *reconcileQueue) Less(i, j int) bool {
+	return q.items[i].due.Before(q.items[j].due)
+}
+func (q *reconcileQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].qIndex = i
+	q.items[j].qIndex = j
+}
+func (q *reconcileQueue) Push(x interface{}) {
+	e := x.(*volumeReconcileEntry)
+	e.qIndex = len(q.items)
+	q.items = append(q.items, e)
+}
+func (q *reconcileQueue) Pop() interface{} {
+	old := q.items
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.qIndex = -1
+	q.items = old[:n-1]
+	return e
+}
+
+// schedule places entry in the queue due at t, or reschedules it if it's
+// already present. Safe to call concurrently.
+func (q *reconcileQueue) schedule(e *volumeReconcileEntry, t time.Time) {
+	q.mu.Lock()
+	e.due = t
+	if e.qIndex >= 0 {
+		heap.Fix(q, e.qIndex)
+	} else {
+		heap.Push(q, e)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next blocks (respecting ctx) until an entry is due, then pops and
+// returns it. Returns nil if ctx is done first.
+func (q *reconcileQueue) next(ctx context.Context) *volumeReconcileEntry {
+	for {
+		q.mu.Lock()
+		if q.Len() == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.wake:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		head := q.items[0]
+		wait := time.Until(head.due)
+		if wait <= 0 {
+			heap.Pop(q)
+			q.mu.Unlock()
+			return head
+		}
+		q.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-q.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package volumewatcher
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// volumeWatcherBaseRetry and volumeWatcherMaxRetry bound the
+	// exponential backoff applied between detach RPC attempts for a
+	// single claim.
+	volumeWatcherBaseRetry = 1 * time.Second
+	volumeWatcherMaxRetry  = 2 * time.Minute
+
+	// volumeWatcherMaxAttempts is how many failed attempts at a claim's
+	// detach RPCs we allow before giving up and marking it UnpublishFailed
+	// so an operator can intervene.
+	volumeWatcherMaxAttempts = 10
+)
+
+// volumeReconcileEntry is the per-volume bookkeeping kept in Watcher.watchers.
+// Unlike the old per-volume goroutine design, an entry owns no goroutine of
+// its own: it just tracks the volume's current view, which claims are
+// mid-retry and when they're next due, and whether it's currently sitting
+// in the Watcher's shared reconcile queue. The Watcher's single reconciler
+// goroutine does the actual work.
+type volumeReconcileEntry struct {
+	w *Watcher
+
+	mu      sync.Mutex
+	vol     *structs.CSIVolume
+	retries *retryHeap
+	queued  bool
+
+	// due is when this entry should next be picked up by the reconciler,
+	// and qIndex is its position in the Watcher's reconcileQueue; both are
+	// owned by the queue and only touched while holding its lock.
+	due    time.Time
+	qIndex int
+}
+
+func newVolumeReconcileEntry(w *Watcher, vol *structs.CSIVolume) *volumeReconcileEntry {
+	return &volumeReconcileEntry{
+		w:       w,
+		vol:     vol,
+		retries: newRetryHeap(),
+		qIndex:  -1,
+	}
+}
+
+// Notify updates the entry's view of the volume and schedules it for
+// reconciliation as soon as possible.
+func (e *volumeReconcileEntry) Notify(vol *structs.CSIVolume) {
+	e.mu.Lock()
+	e.vol = vol
+	e.mu.Unlock()
+	e.w.enqueue(e, time.Time{})
+}
+
+// isRunning reports whether this entry currently has work pending or
+// in-flight in the reconcile queue.
+func (e *volumeReconcileEntry) isRunning() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.queued
+}
+
+func (e *volumeReconcileEntry) setQueued(queued bool) {
+	e.mu.Lock()
+	ns := e.vol.Namespace
+	e.queued = queued
+	e.mu.Unlock()
+
+	if queued {
+		recordWatcherStarted(ns)
+	} else {
+		recordWatcherStopped(ns)
+	}
+}
+
+func (e *volumeReconcileEntry) currentVolume() *structs.CSIVolume {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.vol
+}
+
+// reconcileStep re-reads the volume, processes whichever of its claims are
+// currently due, and reports when (if ever) this entry needs to run again.
+// It's called by the Watcher's single reconciler goroutine, never
+// concurrently for the same entry.
+func (e *volumeReconcileEntry) reconcileStep(w *Watcher) (again bool, nextAttempt time.Time) {
+	vol, err := w.lookupVolume(e.currentVolume())
+	if err != nil {
+		w.logger.Error("failed to query volume", "error", err)
+		return false, time.Time{}
+	}
+	if vol == nil {
+		return false, time.Time{}
+	}
+
+	e.mu.Lock()
+	e.vol = vol
+	e.mu.Unlock()
+
+	claims := claimsNeedingRelease(vol)
+	for _, claim := range claims {
+		e.retries.upsert(claim.AllocationID, time.Time{})
+	}
+	e.retries.removeStale(claims)
+
+	if e.retries.Len() == 0 {
+		return false, time.Time{}
+	}
+
+	next := e.retries.Peek()
+	if !next.due.IsZero() && time.Now().Before(next.due) {
+		return true, next.due
+	}
+
+	claim, ok := claimByAllocID(claims, next.allocID)
+	if !ok {
+		e.retries.remove(next.allocID)
+		return true, time.Time{}
+	}
+
+	firstSeen := next.firstSeen
+	if err := w.processClaim(vol, claim); err != nil {
+		attempt := e.retries.attempt(next.allocID)
+		recordDetachFailure(vol.Namespace, pluginIDOf(vol))
+
+		if attempt >= volumeWatcherMaxAttempts {
+			w.logger.Error("giving up on claim release after max attempts",
+				"volume_id", vol.ID, "alloc_id", next.allocID, "error", err)
+			w.markUnpublishFailed(vol, claim)
+			e.retries.remove(next.allocID)
+			return e.retries.Len() > 0, time.Time{}
+		}
+
+		backoff := backoffWithJitter(attempt)
+		e.retries.reschedule(next.allocID, time.Now().Add(backoff))
+		return true, time.Now().Add(backoff)
+	}
+
+	recordDetachSuccess(vol.Namespace, pluginIDOf(vol))
+	recordTimeToRelease(vol.Namespace, time.Since(firstSeen))
+	e.retries.remove(next.allocID)
+
+	return e.retries.Len() > 0, time.Time{}
+}
+
+// processClaim runs whichever detach RPCs are still outstanding for claim,
+// persisting progress after each so a crash mid-release doesn't repeat
+// work that already succeeded.
+func (w *Watcher) processClaim(vol *structs.CSIVolume, claim *structs.CSIVolumeClaim) error {
+	if claim.NodeID != "" && claim.State == structs.CSIVolumeClaimStateTaken {
+		req := &structs.ClientCSINodeDetachVolumeRequest{
+			VolumeID:     vol.ID,
+			NodeID:       claim.NodeID,
+			AllocationID: claim.AllocationID,
+		}
+		if err := w.rpc.NodeDetachVolume(req, &structs.ClientCSINodeDetachVolumeResponse{}); err != nil {
+			return err
+		}
+
+		claim.State = structs.CSIVolumeClaimStateNodeDetached
+		if err := w.persistClaim(vol, claim); err != nil {
+			return err
+		}
+	}
+
+	if claim.State == structs.CSIVolumeClaimStateNodeDetached {
+		if err := w.pluginLimiter(vol.PluginID).Wait(w.shutdownCtx); err != nil {
+			return err
+		}
+
+		req := &structs.ClientCSIControllerDetachVolumeRequest{
+			VolumeID: vol.ID,
+		}
+		if err := w.rpc.ControllerDetachVolume(req, &structs.ClientCSIControllerDetachVolumeResponse{}); err != nil {
+			return err
+		}
+
+		claim.State = structs.CSIVolumeClaimStateControllerDetached
+	}
+
+	return w.persistClaim(vol, claim)
+}
+
+func (w *Watcher) persistClaim(vol *structs.CSIVolume, claim *structs.CSIVolumeClaim) error {
+	req := structs.CSIVolumeClaimRequest{
+		Namespace:    vol.Namespace,
+		VolumeID:     vol.ID,
+		AllocationID: claim.AllocationID,
+		NodeID:       claim.NodeID,
+		Claim:        structs.CSIVolumeClaimRelease,
+		State:        claim.State,
+	}
+	return w.updateBatcher.Add(req)
+}
+
+func (w *Watcher) markUnpublishFailed(vol *structs.CSIVolume, claim *structs.CSIVolumeClaim) {
+	claim.State = structs.CSIVolumeClaimStateUnpublishFailed
+	if err := w.persistClaim(vol, claim); err != nil {
+		w.logger.Error("failed to persist unpublish-failed claim state", "error", err)
+	}
+}
+
+func claimsNeedingRelease(vol *structs.CSIVolume) []*structs.CSIVolumeClaim {
+	var claims []*structs.CSIVolumeClaim
+	for _, claim := range vol.PastClaims {
+		if claim.State == structs.CSIVolumeClaimStateUnpublishFailed {
+			continue
+		}
+		claims = append(claims, claim)
+	}
+	return claims
+}
+
+func claimByAllocID(claims []*structs.CSIVolumeClaim, allocID string) (*structs.CSIVolumeClaim, bool) {
+	for _, c := range claims {
+		if c.AllocationID == allocID {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func pluginIDOf(vol *structs.CSIVolume) string {
+	if vol == nil {
+		return ""
+	}
+	return vol.PluginID
+}
+
+// backoffWithJitter returns an exponential backoff duration for the given
+// attempt number, capped at volumeWatcherMaxRetry and randomized to between
+// half and all of that duration to avoid many volumes retrying in lockstep.
+func backoffWithJitter(attempt int) time.Duration {
+	backoff := volumeWatcherBaseRetry << uint(attempt)
+	if backoff <= 0 || backoff > volumeWatcherMaxRetry {
+		backoff = volumeWatcherMaxRetry
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(backoff)))
+	return backoff/2 + jitter/2
+}
+
+// retryEntry tracks the next-attempt time for a single claim's release.
+type retryEntry struct {
+	allocID string
+	due     time.Time
+	tries   int
+	index   int
+
+	// firstSeen is when this claim was first added to the heap, i.e. when
+	// its CSIVolumeClaimRelease was first observed. recordTimeToRelease
+	// samples time-to-release from here, not from the most recent RPC
+	// attempt, so retries and backoff count toward the latency.
+	firstSeen time.Time
+}
+
+// retryHeap orders a volume's pending claim retries by due time, so a
+// reconcile step always knows the next claim to act on without scanning.
+type retryHeap struct {
+	items []*retryEntry
+	byID  map[string]*retryEntry
+}
+
+func newRetryHeap() *retryHeap {
+	h := &retryHeap{byID: make(map[string]*retryEntry)}
+	heap.Init(h)
+	return h
+}
+
+func (h *retryHeap) Len() int { return len(h.items) }
+func (h *retryHeap) Less(i, j int) bool {
+	return h.items[i].due.Before(h.items[j].due)
+}
+func (h *retryHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+func (h *retryHeap) Push(x interface{}) {
+	entry := x.(*retryEntry)
+	entry.index = len(h.items)
+	h.items = append(h.items, entry)
+}
+func (h *retryHeap) Pop() interface{} {
+	old := h.items
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	h.items = old[:n-1]
+	return entry
+}
+
+// upsert adds allocID to the heap (if it's not already tracked) with the
+// given due time, or leaves its existing schedule alone.
+func (h *retryHeap) upsert(allocID string, due time.Time) {
+	if _, ok := h.byID[allocID]; ok {
+		return
+	}
+	entry := &retryEntry{allocID: allocID, due: due, firstSeen: time.Now()}
+	h.byID[allocID] = entry
+	heap.Push(h, entry)
+}
+
+// reschedule updates allocID's due time and fixes up the heap order.
+func (h *retryHeap) reschedule(allocID string, due time.Time) {
+	entry, ok := h.byID[allocID]
+	if !ok {
+		return
+	}
+	entry.due = due
+	heap.Fix(h, entry.index)
+}
+
+// remove drops allocID from the heap entirely, e.g. once its claim has
+// been fully released or given up on.
+func (h *retryHeap) remove(allocID string) {
+	entry, ok := h.byID[allocID]
+	if !ok {
+		return
+	}
+	heap.Remove(h, entry.index)
+	delete(h.byID, allocID)
+}
+
+// removeStale drops any tracked allocIDs that are no longer present in
+// claims (e.g. the volume was deregistered out from under us).
+func (h *retryHeap) removeStale(claims []*structs.CSIVolumeClaim) {
+	keep := make(map[string]bool, len(claims))
+	for _, c := range claims {
+		keep[c.AllocationID] = true
+	}
+	for allocID := range h.byID {
+		if !keep[allocID] {
+			h.remove(allocID)
+		}
+	}
+}
+
+// attempt increments and returns the retry count for allocID.
+func (h *retryHeap) attempt(allocID string) int {
+	entry, ok := h.byID[allocID]
+	if !ok {
+		return 0
+	}
+	entry.tries++
+	return entry.tries
+}
+
+// Peek returns the entry with the nearest due time without removing it.
+func (h *retryHeap) Peek() *retryEntry {
+	return h.items[0]
+}
@@ -0,0 +1,268 @@
+package volumewatcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	memdb "github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"golang.org/x/time/rate"
+)
+
+// LimitStateQueriesPerSecond is the default rate at which the watcher is
+// allowed to re-query the state store.
+const LimitStateQueriesPerSecond = 50.0
+
+// DetachRateLimitPerSecond is the default rate at which detach RPCs are
+// sent to any single controller plugin, independent of
+// LimitStateQueriesPerSecond. Plugins are typically backed by a cloud
+// provider API with its own request quota, so this is kept conservative
+// and per-plugin rather than global.
+const DetachRateLimitPerSecond = 10.0
+
+// Watcher watches for CSI volumes that have claims which need to be
+// released (because the claiming allocation has stopped) and runs the
+// ControllerDetachVolume / NodeDetachVolume RPCs required to free them.
+// It's only active on the leader.
+//
+// Rather than a goroutine per volume, a single due-time-ordered queue of
+// volumeReconcileEntry values is drained by one reconciler goroutine:
+// goroutine and memdb watch-set counts stay fixed regardless of how many
+// volumes (or controller plugins) are being watched. Controller detach RPCs
+// are rate-limited per controller plugin via pluginLimiter, independent of
+// LimitStateQueriesPerSecond; node detach RPCs are not rate-limited. Detach
+// RPCs are sent one claim at a time, not batched, and a pluginLimiter wait
+// blocks the single reconciler goroutine for every plugin.
+type Watcher struct {
+	enabled bool
+	logger  log.Logger
+
+	rpc      VolumeRPC
+	claimRPC ClaimUpdateRPC
+
+	rateLimit     float64
+	batchDuration time.Duration
+
+	updateBatcher *volumeUpdateBatcher
+
+	watchers map[string]*volumeReconcileEntry
+
+	// queue is the shared work queue drained by the single reconciler
+	// goroutine started in SetEnabled. nil whenever the watcher is
+	// disabled.
+	queue *reconcileQueue
+
+	// stateLimiter caps how often the reconciler re-queries the state
+	// store, independent of pluginLimiters which cap detach RPCs.
+	stateLimiter *rate.Limiter
+
+	pluginLimiters map[string]*rate.Limiter
+	pluginLock     sync.Mutex
+
+	currentState *state.StateStore
+
+	shutdownCtx    context.Context
+	shutdownCancel context.CancelFunc
+
+	wlock sync.RWMutex
+}
+
+// NewVolumesWatcher creates a volume watcher. SetEnabled must be called
+// before it does any work, typically from the leader loop.
+func NewVolumesWatcher(logger log.Logger, rpc VolumeRPC, claimRPC ClaimUpdateRPC,
+	rateLimit float64, batchDuration time.Duration) *Watcher {
+
+	w := &Watcher{
+		logger:         logger.Named("volume_watcher"),
+		rpc:            rpc,
+		claimRPC:       claimRPC,
+		rateLimit:      rateLimit,
+		batchDuration:  batchDuration,
+		watchers:       make(map[string]*volumeReconcileEntry),
+		stateLimiter:   rate.NewLimiter(rate.Limit(rateLimit), 1),
+		pluginLimiters: make(map[string]*rate.Limiter),
+	}
+	w.shutdownCtx, w.shutdownCancel = context.WithCancel(context.Background())
+	return w
+}
+
+// SetEnabled turns the watcher on or off. Enabling starts a scan of every
+// volume currently in the state store; disabling stops the reconciler and
+// discards every pending watcher.
+func (w *Watcher) SetEnabled(enabled bool, state *state.StateStore) {
+	w.wlock.Lock()
+	wasEnabled := w.enabled
+	w.enabled = enabled
+	w.wlock.Unlock()
+
+	if !enabled {
+		w.stopAll()
+		return
+	}
+
+	if !wasEnabled {
+		w.wlock.Lock()
+		w.shutdownCtx, w.shutdownCancel = context.WithCancel(context.Background())
+		w.updateBatcher = NewVolumeUpdateBatcher(w.shutdownCtx, w.batchDuration, w.claimRPC)
+		w.queue = newReconcileQueue()
+		ctx, queue := w.shutdownCtx, w.queue
+		w.wlock.Unlock()
+
+		go w.reconcileLoop(ctx, queue)
+	}
+
+	if state != nil {
+		w.listen(state)
+	}
+}
+
+// stopAll stops the reconciler and clears every pending watcher. Called
+// when stepping down from leadership.
+func (w *Watcher) stopAll() {
+	w.wlock.Lock()
+	if w.shutdownCancel != nil {
+		w.shutdownCancel()
+	}
+	w.watchers = make(map[string]*volumeReconcileEntry)
+	w.currentState = nil
+	w.queue = nil
+	w.wlock.Unlock()
+
+	recordActiveWatchers(0)
+}
+
+// reconcileLoop drains queue until ctx is done. A single instance of this
+// loop, started once in SetEnabled, replaces what used to be one goroutine
+// per volume.
+func (w *Watcher) reconcileLoop(ctx context.Context, queue *reconcileQueue) {
+	for {
+		entry := queue.next(ctx)
+		if entry == nil {
+			return
+		}
+
+		again, next := entry.reconcileStep(w)
+		if again {
+			queue.schedule(entry, next)
+		} else {
+			entry.setQueued(false)
+		}
+	}
+}
+
+// enqueue schedules entry to be picked up by the reconciler as soon as
+// possible (a zero due time) or at a specific due time for backoff.
+func (w *Watcher) enqueue(entry *volumeReconcileEntry, due time.Time) {
+	if !entry.isRunning() {
+		entry.setQueued(true)
+	}
+
+	w.wlock.RLock()
+	queue := w.queue
+	w.wlock.RUnlock()
+	if queue == nil {
+		return
+	}
+	queue.schedule(entry, due)
+}
+
+// pluginLimiter returns the shared rate limiter for detach RPCs sent to
+// pluginID, creating one if this is the first time we've seen it.
+func (w *Watcher) pluginLimiter(pluginID string) *rate.Limiter {
+	w.pluginLock.Lock()
+	defer w.pluginLock.Unlock()
+
+	limiter, ok := w.pluginLimiters[pluginID]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(DetachRateLimitPerSecond), 1)
+		w.pluginLimiters[pluginID] = limiter
+	}
+	return limiter
+}
+
+// lookupVolume re-reads vol from the state store, returning nil if it's
+// been deregistered.
+func (w *Watcher) lookupVolume(vol *structs.CSIVolume) (*structs.CSIVolume, error) {
+	w.wlock.RLock()
+	s := w.currentState
+	ctx := w.shutdownCtx
+	w.wlock.RUnlock()
+	if s == nil {
+		return nil, nil
+	}
+
+	if err := w.stateLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	ws := memdb.NewWatchSet()
+	return s.CSIVolumeByID(ws, vol.Namespace, vol.ID)
+}
+
+// listen does an initial sweep of the volumes table, scheduling
+// reconciliation for any volume that has claims needing release, and
+// registers a blocking watch for future changes.
+func (w *Watcher) listen(s *state.StateStore) {
+	w.wlock.Lock()
+	w.currentState = s
+	w.wlock.Unlock()
+
+	ws := memdb.NewWatchSet()
+	iter, err := s.CSIVolumes(ws)
+	if err != nil {
+		w.logger.Error("failed to query CSI volumes", "error", err)
+		return
+	}
+
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+		vol := raw.(*structs.CSIVolume)
+		w.notify(vol)
+	}
+
+	go w.watchForChanges(s, ws)
+}
+
+// watchForChanges blocks on the watch set gathered while listing volumes
+// until a write touches one of them, then re-lists so new or updated
+// volumes get scheduled.
+func (w *Watcher) watchForChanges(s *state.StateStore, ws memdb.WatchSet) {
+	if err := ws.WatchCtx(w.shutdownCtx); err != nil {
+		return // shut down
+	}
+
+	w.wlock.RLock()
+	enabled := w.enabled
+	w.wlock.RUnlock()
+	if !enabled {
+		return
+	}
+
+	w.listen(s)
+}
+
+// notify creates (or wakes) the reconcile entry for vol.
+func (w *Watcher) notify(vol *structs.CSIVolume) {
+	w.wlock.Lock()
+	if !w.enabled {
+		w.wlock.Unlock()
+		return
+	}
+
+	id := vol.ID + vol.Namespace
+	entry, ok := w.watchers[id]
+	if !ok {
+		entry = newVolumeReconcileEntry(w, vol)
+		w.watchers[id] = entry
+		recordActiveWatchers(len(w.watchers))
+	}
+	w.wlock.Unlock()
+
+	entry.Notify(vol)
+}
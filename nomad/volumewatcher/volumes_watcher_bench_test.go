@@ -0,0 +1,94 @@
+package volumewatcher
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/helper/testlog"
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// BenchmarkVolumeWatcher_MassRelease registers a large number of volumes
+// each with one claim needing release, then releases them all at once.
+// It's meant to be compared against the old per-volume-goroutine design:
+// goroutine count should stay flat as volume count grows, since every
+// volume is reconciled off one shared queue by the Watcher's single
+// reconciler goroutine instead of one goroutine each. Each plugin has its
+// own controller detach rate limiter, but waits on it run on that single
+// goroutine, so a throttled plugin delays the others' claims too.
+func BenchmarkVolumeWatcher_MassRelease(b *testing.B) {
+	const numVolumes = 5000
+	const numPlugins = 20
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		srv := &MockStatefulRPCServer{}
+		srv.state = state.TestStateStore(b)
+		index := uint64(100)
+
+		watcher := NewVolumesWatcher(testlog.HCLogger(b),
+			srv, srv,
+			LimitStateQueriesPerSecond,
+			CrossVolumeUpdateBatchDuration)
+
+		plugins := make([]*structs.CSIPlugin, 0, numPlugins)
+		for p := 0; p < numPlugins; p++ {
+			plugins = append(plugins, mock.CSIPlugin())
+		}
+
+		vols := make([]*structs.CSIVolume, 0, numVolumes)
+		for n := 0; n < numVolumes; n++ {
+			plugin := plugins[n%numPlugins]
+			node := testNode(nil, plugin, srv.State())
+			alloc := mock.Alloc()
+			alloc.ClientStatus = structs.AllocClientStatusComplete
+			vol := testVolume(nil, plugin, alloc, node.ID)
+			vols = append(vols, vol)
+		}
+
+		index++
+		if err := srv.State().CSIVolumeRegister(index, vols); err != nil {
+			b.Fatal(err)
+		}
+
+		watcher.SetEnabled(true, srv.State())
+
+		before := runtime.NumGoroutine()
+		b.StartTimer()
+		start := time.Now()
+
+		for _, vol := range vols {
+			claim := &structs.CSIVolumeClaim{Mode: structs.CSIVolumeClaimRelease}
+			index++
+			if err := srv.State().CSIVolumeClaim(index, vol.Namespace, vol.ID, claim); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		deadline := time.Now().Add(30 * time.Second)
+		for time.Now().Before(deadline) {
+			released := 0
+			for _, vol := range vols {
+				id := vol.ID + vol.Namespace
+				if entry, ok := watcher.watchers[id]; ok && !entry.isRunning() {
+					released++
+				}
+			}
+			if released == numVolumes {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		drained := time.Since(start)
+		b.StopTimer()
+		after := runtime.NumGoroutine()
+		b.ReportMetric(float64(after-before), "goroutines/op")
+		b.ReportMetric(float64(drained.Milliseconds()), "ms/drain")
+		watcher.SetEnabled(false, nil)
+	}
+}
@@ -289,3 +289,62 @@ func TestVolumeWatch_RegisterDeregister(t *testing.T) {
 	require.Equal(1, len(watcher.watchers))
 	require.False(watcher.watchers[vol.ID+vol.Namespace].isRunning())
 }
+
+// TestVolumeWatch_RegisterDeregister_Retry asserts that a transient
+// controller detach RPC failure is retried with backoff rather than
+// immediately marked as failed, and that the claim still ends up released
+// once the injected failures stop.
+func TestVolumeWatch_RegisterDeregister_Retry(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ctx, exitFn := context.WithCancel(context.Background())
+	defer exitFn()
+
+	srv := &MockStatefulRPCServer{}
+	srv.state = state.TestStateStore(t)
+	srv.volumeUpdateBatcher = NewVolumeUpdateBatcher(
+		ctx, CrossVolumeUpdateBatchDuration, srv)
+	srv.failCSIControllerDetachVolumeN = 2
+
+	index := uint64(100)
+
+	watcher := NewVolumesWatcher(testlog.HCLogger(t),
+		srv, srv,
+		LimitStateQueriesPerSecond,
+		CrossVolumeUpdateBatchDuration)
+
+	watcher.SetEnabled(true, srv.State())
+
+	plugin := mock.CSIPlugin()
+	node := testNode(nil, plugin, srv.State())
+	alloc := mock.Alloc()
+	alloc.ClientStatus = structs.AllocClientStatusComplete
+
+	vol := testVolume(nil, plugin, alloc, node.ID)
+	index++
+	err := srv.State().CSIVolumeRegister(index, []*structs.CSIVolume{vol})
+	require.NoError(err)
+
+	require.Eventually(func() bool {
+		return 1 == len(watcher.watchers)
+	}, time.Second, 10*time.Millisecond)
+
+	w := watcher.watchers[vol.ID+vol.Namespace]
+	w.Notify(vol)
+
+	// the first two controller detach attempts fail and must be retried
+	// with backoff rather than giving up immediately.
+	require.Eventually(func() bool {
+		ws := memdb.NewWatchSet()
+		vol, _ := srv.State().CSIVolumeByID(ws, vol.Namespace, vol.ID)
+		return len(vol.ReadAllocs) == 0 && len(vol.PastClaims) == 0
+	}, time.Second*10, 10*time.Millisecond)
+
+	require.Eventually(func() bool {
+		return !watcher.watchers[vol.ID+vol.Namespace].isRunning()
+	}, time.Second*2, 10*time.Millisecond)
+
+	require.GreaterOrEqual(srv.countCSIControllerDetachVolume, 3,
+		"controller detach RPC should have been retried past the injected failures")
+}